@@ -0,0 +1,245 @@
+// Package fmp4 builds fragmented MP4 (CMAF-compatible) segments containing
+// a single raw AAC audio track, as an alternative to the MPEG-TS packager
+// in the parent hls package.
+//
+// https://www.w3.org/TR/mse-byte-stream-format-isobmff/
+package fmp4
+
+import "encoding/binary"
+
+// Timescale is used for every duration/timestamp field this package writes,
+// matching the nanosecond convention used throughout the rest of the repo.
+const Timescale = 1000000000
+
+const trackID = 1
+
+// box wraps payload in a length-prefixed ISOBMFF box of the given
+// four-character type.
+func box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b[0:4], uint32(size))
+	copy(b[4:8], boxType)
+
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+func concat(bs ...[]byte) []byte {
+	var out []byte
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func u8(v uint8) []byte   { return []byte{v} }
+func u24(v uint32) []byte { return []byte{byte(v >> 16), byte(v >> 8), byte(v)} }
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// identityMatrix is the unity transformation matrix ISOBMFF stores in tkhd/mvhd.
+func identityMatrix() []byte {
+	return concat(u32(0x00010000), u32(0), u32(0), u32(0), u32(0x00010000), u32(0), u32(0), u32(0), u32(0x40000000))
+}
+
+// audioSpecificConfig builds the 2-byte MPEG-4 AudioSpecificConfig ES
+// descriptor from the fields already present in every ADTS frame header.
+func audioSpecificConfig(profile, samplingFrequencyIndex, channelConfiguration int) []byte {
+	objectType := uint16(profile) + 1 // ADTS profile is audioObjectType - 1
+	v := (objectType << 11) | (uint16(samplingFrequencyIndex) << 7) | (uint16(channelConfiguration) << 3)
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func descriptor(tag byte, payload []byte) []byte {
+	return append([]byte{tag, byte(len(payload))}, payload...)
+}
+
+// esds wraps an AudioSpecificConfig in the minimal MPEG-4 ES/DecoderConfig/
+// SLConfig descriptor chain required for mp4a decoding.
+func esds(asc []byte) []byte {
+	dsi := descriptor(0x05, asc) // DecoderSpecificInfo
+
+	dcd := descriptor(0x04, concat(
+		[]byte{0x40, 0x15}, // objectTypeIndication (MPEG-4 Audio), streamType (audio) + upStream + reserved
+		[]byte{0, 0, 0},    // bufferSizeDB
+		u32(0),             // maxBitrate
+		u32(0),             // avgBitrate
+		dsi,
+	))
+
+	slc := descriptor(0x06, []byte{0x02}) // SLConfigDescriptor: predefined = MP4
+
+	esd := descriptor(0x03, concat(u16(0), u8(0), dcd, slc)) // ES_ID, flags
+
+	return box("esds", concat(u32(0), esd)) // full box version/flags
+}
+
+func mp4a(sampleRate uint32, channelConfiguration int, asc []byte) []byte {
+	entry := concat(
+		make([]byte, 6), // reserved
+		u16(1),          // data_reference_index
+		make([]byte, 8), // reserved
+		u16(uint16(channelConfiguration)),
+		u16(16),         // samplesize
+		make([]byte, 4), // pre_defined + reserved
+		u32(sampleRate<<16),
+		esds(asc),
+	)
+	return box("mp4a", entry)
+}
+
+func stsd(sampleEntry []byte) []byte {
+	return box("stsd", concat(u32(0), u32(1), sampleEntry))
+}
+
+// stbl is empty of sample tables here - the samples for a fragmented track
+// live in moof/traf boxes, not moov.
+func stbl(sampleEntry []byte) []byte {
+	stts := box("stts", concat(u32(0), u32(0)))
+	stsc := box("stsc", concat(u32(0), u32(0)))
+	stsz := box("stsz", concat(u32(0), u32(0), u32(0)))
+	stco := box("stco", concat(u32(0), u32(0)))
+	return box("stbl", stsd(sampleEntry), stts, stsc, stsz, stco)
+}
+
+func smhd() []byte {
+	return box("smhd", concat(u32(0), u16(0), u16(0)))
+}
+
+func dinf() []byte {
+	url := box("url ", u32(1)) // flags=1: media data is in this file
+	dref := box("dref", concat(u32(0), u32(1), url))
+	return box("dinf", dref)
+}
+
+func minf(sampleEntry []byte) []byte {
+	return box("minf", smhd(), dinf(), stbl(sampleEntry))
+}
+
+func mdhd() []byte {
+	return box("mdhd", concat(u32(0), u32(0), u32(0), u32(Timescale), u32(0), u16(0x55c4), u16(0))) // language 'und'
+}
+
+func hdlr() []byte {
+	return box("hdlr", concat(u32(0), u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00")))
+}
+
+func mdia(sampleEntry []byte) []byte {
+	return box("mdia", mdhd(), hdlr(), minf(sampleEntry))
+}
+
+func tkhd() []byte {
+	const flags = 0x000007 // track_enabled | track_in_movie | track_in_preview
+	return box("tkhd", concat(
+		u8(0), u24(flags),
+		u32(0), u32(0), // creation, modification time
+		u32(trackID),
+		u32(0),          // reserved
+		u32(0),          // duration
+		make([]byte, 8), // reserved
+		u16(0), u16(0),  // layer, alternate_group
+		u16(0x0100), u16(0), // volume, reserved
+		identityMatrix(),
+		u32(0), u32(0), // width, height (unused for audio)
+	))
+}
+
+func trak(sampleEntry []byte) []byte {
+	return box("trak", tkhd(), mdia(sampleEntry))
+}
+
+func trex() []byte {
+	return box("trex", concat(u32(0), u32(trackID), u32(1), u32(0), u32(0), u32(0)))
+}
+
+func mvex() []byte {
+	return box("mvex", trex())
+}
+
+func mvhd() []byte {
+	return box("mvhd", concat(
+		u32(0), u32(0), u32(0), // version/flags, creation, modification time
+		u32(Timescale), u32(0), // timescale, duration
+		u32(0x00010000), u16(0x0100), u16(0), // rate, volume, reserved
+		u32(0), u32(0), // reserved
+		identityMatrix(),
+		make([]byte, 24), // pre_defined
+		u32(trackID+1),   // next_track_ID
+	))
+}
+
+func moov(sampleEntry []byte) []byte {
+	return box("moov", mvhd(), trak(sampleEntry), mvex())
+}
+
+func ftyp() []byte {
+	return box("ftyp", concat([]byte("iso5"), u32(0), []byte("iso5"), []byte("iso6"), []byte("mp41")))
+}
+
+// InitSegment builds an fMP4 initialization segment (ftyp+moov) declaring a
+// single AAC-LC audio track, from the fields carried in every ADTS frame
+// header (profile, sampling frequency index, channel configuration) plus
+// the frame's real sampling frequency in Hz.
+func InitSegment(profile, samplingFrequencyIndex, channelConfiguration int, sampleRate uint32) []byte {
+	asc := audioSpecificConfig(profile, samplingFrequencyIndex, channelConfiguration)
+	sampleEntry := mp4a(sampleRate, channelConfiguration, asc)
+	return append(ftyp(), moov(sampleEntry)...)
+}
+
+// MediaSegment builds a single-track fMP4 media segment (moof+mdat)
+// containing samples (raw AAC access units, i.e. adts.Frame.AACFrame()),
+// each with its duration in Timescale units. seq is the fragment sequence
+// number (matches sequence_number in mfhd) and baseTime is the media
+// decode time of the first sample, also in Timescale units.
+func MediaSegment(seq uint32, baseTime uint64, samples [][]byte, durations []uint64) []byte {
+	mfhd := box("mfhd", concat(u32(0), u32(seq)))
+	tfhd := box("tfhd", concat(u8(0), u24(0x020000), u32(trackID))) // default-base-is-moof
+
+	tfdtVersion1 := concat(u8(1), u24(0), u64(baseTime))
+	tfdt := box("tfdt", tfdtVersion1)
+
+	const trunFlags = 0x000301 // data-offset-present | sample-duration-present | sample-size-present
+	entries := make([]byte, 0, len(samples)*8)
+	for i, s := range samples {
+		entries = append(entries, u32(uint32(durations[i]))...)
+		entries = append(entries, u32(uint32(len(s)))...)
+	}
+	trun := box("trun", concat(u8(0), u24(trunFlags), u32(uint32(len(samples))), u32(0), entries))
+
+	traf := box("traf", tfhd, tfdt, trun)
+	moof := box("moof", mfhd, traf)
+
+	// patch trun's data_offset now that we know how big moof turned out to be:
+	// header(8) + version/flags(4) + sample_count(4) puts data_offset at byte 16 of trun
+	dataOffset := uint32(len(moof) + 8) // +8 for the mdat box header
+	trunOffsetInMoof := len(moof) - len(trun) + 16
+	binary.BigEndian.PutUint32(moof[trunOffsetInMoof:trunOffsetInMoof+4], dataOffset)
+
+	mdat := box("mdat", concat(samples...))
+
+	return append(moof, mdat...)
+}
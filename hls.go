@@ -8,13 +8,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"hls/adts"
+	"hls/fmp4"
 	"hls/mpegts"
+	"hls/transcode"
 )
 
 // values used are taken from an example working server (Wowza, if I recall correctly)
@@ -23,19 +28,126 @@ const PROGRAM_MAP_PID = 4095
 const STREAM_PACKET_IDENTIFIER = 257
 const STREAM_ID = 192
 const ESD_PID = 258
+const ID3_STREAM_ID = 0xBD // private_stream_1, used here for ID3 timed metadata
 
 type packet = [188]byte
 
-type chunk struct {
+// partTarget is the target duration of an LL-HLS partial segment.
+const partTarget = 350 * time.Millisecond
+
+// blockingReloadTimeout bounds how long a chunklist.m3u8 request with
+// _HLS_msn/_HLS_part params will be held open waiting for that part to
+// become available, per the CAN-BLOCK-RELOAD contract.
+const blockingReloadTimeout = 9 * partTarget
+
+// part is a byte-range within a chunk's data ending at a PES boundary,
+// advertised to LL-HLS clients before the chunk it belongs to is complete.
+type part struct {
 	index    uint64
 	duration uint64
-	data     []byte
+	offset   int
+	length   int
+}
+
+type chunk struct {
+	index         uint64
+	duration      uint64
+	data          []byte // nil once spilled to disk - see renditionStream.spillDir
+	parts         []part
+	time          time.Time // wall-clock time the segment started, for EXT-X-PROGRAM-DATE-TIME
+	discontinuity bool      // true if any frame packaged into this segment carried sourceFrame.discontinuity
+}
+
+// sourceFrame pairs a demuxed ADTS frame with the ICY StreamTitle that was
+// current when it arrived. title is only set on the frame immediately
+// following a metadata block whose StreamTitle changed, so that it can be
+// packetized once as ID3 timed metadata rather than on every frame.
+type sourceFrame struct {
+	frame         adts.Frame
+	title         string
+	discontinuity bool // true on the first frame after a signalled discontinuity (eg. an HLS #EXT-X-DISCONTINUITY), so adtsToMPEGTS can soft-restart instead of erroring on the sampling-frequency change
+}
+
+// segmentFormat selects the container used for media segments.
+type segmentFormat int
+
+const (
+	formatTS segmentFormat = iota
+	formatFMP4
+)
+
+// rendition is one target bitrate of a mount. bitrate == 0 is the source
+// rendition: the original stream, passed through without transcoding.
+type rendition struct {
+	name    string // path segment, eg. "128k"; "source" for the passthrough rendition
+	bitrate uint   // target AAC bitrate in bits/sec, 0 for passthrough
+}
+
+// mountConfig is a mount point together with the renditions it should be
+// transcoded to (in addition to the always-present source rendition) and
+// its DVR retention policy.
+type mountConfig struct {
+	name          string
+	renditions    []rendition
+	windowSeconds uint // 0: no DVR window beyond the in-memory ring (see hotSegments)
+	maxSegments   uint // 0: defaults to defaultAdvertisedSegments
+}
+
+// parseMounts turns CLI mount arguments into mountConfigs. The syntax is
+// name[:windowSeconds[:maxSegments]][=renditions], eg.:
+//
+//	radio1                     - source bitrate only, default DVR window
+//	radio1=128k,64k,32k        - transcoded renditions added
+//	radio1:3600:360=128k,64k   - a 1 hour / 360 segment DVR window, plus renditions
+func parseMounts(args []string) (mounts []mountConfig) {
+	for _, a := range args {
+		spec := a
+		renditions := []rendition{{name: "source"}}
+
+		if i := strings.IndexByte(spec, '='); i >= 0 {
+			for _, label := range strings.Split(spec[i+1:], ",") {
+				if b, ok := parseBitrate(label); ok {
+					renditions = append(renditions, rendition{name: label, bitrate: b})
+				}
+			}
+			spec = spec[:i]
+		}
+
+		fields := strings.Split(spec, ":")
+
+		mc := mountConfig{name: fields[0], renditions: renditions}
+
+		if len(fields) > 1 {
+			if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+				mc.windowSeconds = uint(n)
+			}
+		}
+		if len(fields) > 2 {
+			if n, err := strconv.Atoi(fields[2]); err == nil && n >= minAdvertisedSegments {
+				mc.maxSegments = uint(n)
+			}
+		}
+
+		mounts = append(mounts, mc)
+	}
+	return
+}
+
+// parseBitrate parses a label like "128k" into a bits/sec value.
+func parseBitrate(label string) (uint, bool) {
+	n, err := strconv.Atoi(strings.TrimSuffix(label, "k"))
+	if err != nil || n <= 0 || !strings.HasSuffix(label, "k") {
+		return 0, false
+	}
+	return uint(n) * 1000, true
 }
 
 func main() {
 
 	redirect := flag.String("r", "", "redirect url for non-existent pages")
 	minimum := flag.Uint("m", 0, "minimum number of active streams required for server to be deemed healthy")
+	useFMP4 := flag.Bool("f", false, "package segments as fMP4/CMAF (.m4s) instead of MPEG-TS")
+	spill := flag.String("spill", "", "directory to spill segments older than the in-memory ring to, allowing a DVR window longer than fits in RAM")
 
 	flag.Parse()
 
@@ -43,9 +155,14 @@ func main() {
 
 	addr := args[0]
 	base := args[1]
-	list := args[2:]
+	mounts := parseMounts(args[2:])
 
-	directory := startdirectory(base, list)
+	format := formatTS
+	if *useFMP4 {
+		format = formatFMP4
+	}
+
+	directory := startdirectory(base, mounts, format, *spill)
 	server(addr, directory, *redirect, *minimum)
 }
 
@@ -54,7 +171,7 @@ type directory struct {
 	streams map[string]*stream
 }
 
-func startdirectory(base string, streams []string) *directory {
+func startdirectory(base string, mounts []mountConfig, format segmentFormat, spillDir string) *directory {
 	d := &directory{streams: map[string]*stream{}}
 
 	go func() {
@@ -64,9 +181,9 @@ func startdirectory(base string, streams []string) *directory {
 		for {
 
 			d.mutex.Lock()
-			for _, s := range streams {
-				if _, ok := d.streams[s]; !ok {
-					d.streams[s] = start(base, s)
+			for _, mc := range mounts {
+				if _, ok := d.streams[mc.name]; !ok {
+					d.streams[mc.name] = start(base, mc, format, spillDir)
 				}
 			}
 
@@ -105,35 +222,189 @@ func (d *directory) list() (list []string) {
 	return
 }
 
+// stream is a mount point: a single source ingest fanned out to one
+// renditionStream per configured target bitrate (plus the always-present
+// "source" passthrough rendition).
 type stream struct {
-	mutex sync.Mutex
-	list  []chunk
-	done  chan bool
+	renditions map[string]*renditionStream
+	order      []string // rendition names, in mountConfig order, for playlist.m3u8
+	done       chan bool
 }
 
-func (s *stream) bandwidth() uint {
+func (s *stream) ok() bool {
+	for _, rs := range s.renditions {
+		if rs.ok() {
+			return true
+		}
+	}
+	return false
+}
+
+// hotSegments is the number of most-recent completed segments kept fully
+// in memory. Without a DVR window (windowSeconds == 0) older segments are
+// dropped, whether or not spillDir is set. With one, older segments are
+// spilled to disk (if spillDir is set) or kept in memory (if not) until they
+// fall outside the window - see retainLocked.
+const hotSegments = 10
+
+// defaultAdvertisedSegments is how many segments index() advertises when a
+// mountConfig doesn't set maxSegments - matches the original fixed 3.
+const defaultAdvertisedSegments = 3
+
+// minAdvertisedSegments is the floor parseMounts enforces on an explicit
+// maxSegments: below it, chunklist.m3u8's own minimum-segment-count check
+// (see the chunklist.m3u8 handler) would 404 the mount forever.
+const minAdvertisedSegments = 3
+
+type renditionStream struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	list    []chunk
+	current chunk // segment presently being assembled; not yet in list
+	done    chan bool
+	format  segmentFormat
+	init    []byte // fMP4 initialization segment, set once the first frame arrives (formatFMP4 only)
+	bitrate uint   // target bitrate in bits/sec; 0 for the passthrough "source" rendition
+
+	windowSeconds uint   // 0: no DVR window beyond hotSegments
+	maxSegments   uint   // 0: defaultAdvertisedSegments
+	spillDir      string // "" disables on-disk spill of segments older than hotSegments
+}
+
+func (s *renditionStream) extension() string {
+	if s.format == formatFMP4 {
+		return "m4s"
+	}
+	return "ts"
+}
+
+func (s *renditionStream) initSegment() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.init
+}
+
+// bandwidth is the value advertised as BANDWIDTH for this rendition in
+// playlist.m3u8. Transcoded renditions use their configured target bitrate;
+// the passthrough "source" rendition falls back to an estimate taken from
+// an example working server, since the true source bitrate isn't known here.
+func (s *renditionStream) bandwidth() uint {
+	if s.bitrate != 0 {
+		return s.bitrate
+	}
 	return 52850
 }
 
-func (s *stream) chunk(i uint64) []byte {
+func (s *renditionStream) chunk(i uint64) []byte {
+	s.mutex.Lock()
+	c, ok := s.chunkLocked(i)
+	spillDir := s.spillDir
+	s.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if c.data != nil || spillDir == "" {
+		return c.data
+	}
+
+	data, err := os.ReadFile(s.segmentPath(i))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// part returns the byte range of part p of segment i, looking in both
+// completed segments and the one currently being assembled. Segments whose
+// data has been spilled to disk (see retainLocked) have no parts data available.
+func (s *renditionStream) part(i, p uint64) []byte {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	c, ok := s.chunkLocked(i)
+	if !ok || p >= uint64(len(c.parts)) || len(c.data) == 0 {
+		return nil
+	}
+
+	pt := c.parts[p]
+	return c.data[pt.offset : pt.offset+pt.length]
+}
+
+// segmentPath is where a spilled segment's bytes live on disk.
+func (s *renditionStream) segmentPath(i uint64) string {
+	return filepath.Join(s.spillDir, fmt.Sprintf("%d.%s", i, s.extension()))
+}
+
+// retainLocked enforces the DVR retention policy after a new segment is
+// appended to s.list. With no DVR window configured this just keeps the
+// hot in-memory ring, matching the original fixed behaviour. With a window
+// configured, segments beyond the hot ring have their data spilled to disk
+// (if spillDir is set) and dropped from memory instead, and segments older
+// than the window are evicted (and their spilled file removed) entirely. A
+// segment whose spill fails is logged and left in memory rather than
+// silently dropped, at the cost of holding onto it past the hot ring until
+// retainLocked can spill it successfully on a later call.
+// Must be called with mutex held.
+func (s *renditionStream) retainLocked() {
+	if s.windowSeconds == 0 {
+		for len(s.list) > hotSegments {
+			s.list = s.list[1:]
+		}
+		return
+	}
+
+	for i := 0; i < len(s.list)-hotSegments; i++ {
+		c := &s.list[i]
+		if c.data == nil || s.spillDir == "" {
+			continue
+		}
+		if err := os.MkdirAll(s.spillDir, 0755); err != nil {
+			log.Printf("spill segment %s: %v", s.segmentPath(c.index), err)
+			continue
+		}
+		if err := os.WriteFile(s.segmentPath(c.index), c.data, 0644); err != nil {
+			log.Printf("spill segment %s: %v", s.segmentPath(c.index), err)
+			continue
+		}
+		c.data = nil
+	}
+
+	for len(s.list) > 0 && time.Since(s.list[0].time) > time.Duration(s.windowSeconds)*time.Second {
+		if s.spillDir != "" {
+			os.Remove(s.segmentPath(s.list[0].index))
+		}
+		s.list = s.list[1:]
+	}
+}
+
+func (s *renditionStream) chunkLocked(i uint64) (chunk, bool) {
+	if s.current.index == i {
+		return s.current, true
+	}
 	for _, c := range s.list {
 		if c.index == i {
-			return c.data
+			return c, true
 		}
 	}
-	return nil
+	return chunk{}, false
 }
 
-func (s *stream) ok() bool {
+func (s *renditionStream) ok() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	return len(s.list) > 2
 }
 
-func (s *stream) index() (list [][2]uint64) {
+// chunkMeta is the subset of chunk advertised in chunklist.m3u8.
+type chunkMeta struct {
+	index         uint64
+	duration      uint64
+	time          time.Time
+	discontinuity bool
+}
+
+func (s *renditionStream) index() (list []chunkMeta) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -142,72 +413,373 @@ func (s *stream) index() (list [][2]uint64) {
 	}
 
 	for _, c := range s.list {
-		list = append(list, [2]uint64{c.index, c.duration})
+		list = append(list, chunkMeta{index: c.index, duration: c.duration, time: c.time, discontinuity: c.discontinuity})
+	}
+
+	max := s.maxSegments
+	if max == 0 {
+		max = defaultAdvertisedSegments
 	}
 
-	for len(list) > 3 {
+	for uint(len(list)) > max {
 		list = list[1:]
 	}
 
 	return
 }
 
-func start(base, name string) (s *stream) {
+// partsOf returns the segment number currently being assembled and the
+// parts completed for it so far, for advertising in chunklist.m3u8.
+func (s *renditionStream) partsOf(lastAdvertised uint64) (msn uint64, parts []part) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current.index <= lastAdvertised {
+		return lastAdvertised, nil
+	}
+	return s.current.index, append([]part{}, s.current.parts...)
+}
+
+// partReadyLocked reports whether segment msn has at least part p ready to
+// serve - either because it's a completed segment (any part is "ready"
+// since the whole segment is present) or because the in-progress segment
+// has produced that many parts already. Must be called with mutex held.
+func (s *renditionStream) partReadyLocked(msn, p uint64) bool {
+	c, ok := s.chunkLocked(msn)
+	if !ok {
+		return false
+	}
+	return c.index != s.current.index || uint64(len(c.parts)) > p
+}
+
+// awaitPart blocks until segment msn has produced part p, or until timeout
+// elapses, to implement blocking playlist reload for LL-HLS.
+func (s *renditionStream) awaitPart(msn, p uint64, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
 
-	s = &stream{done: make(chan bool)}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for !s.partReadyLocked(msn, p) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+
+		timer := time.AfterFunc(remaining, func() {
+			s.mutex.Lock()
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+		})
+		s.cond.Wait()
+		timer.Stop()
+	}
+}
+
+func start(base string, mc mountConfig, format segmentFormat, spillDir string) (s *stream) {
+
+	s = &stream{renditions: map[string]*renditionStream{}, done: make(chan bool)}
+
+	for _, r := range mc.renditions {
+		rs := &renditionStream{
+			done:          make(chan bool),
+			format:        format,
+			bitrate:       r.bitrate,
+			windowSeconds: mc.windowSeconds,
+			maxSegments:   mc.maxSegments,
+		}
+		if spillDir != "" {
+			rs.spillDir = filepath.Join(spillDir, mc.name, r.name)
+		}
+		rs.cond = sync.NewCond(&rs.mutex)
+		s.renditions[r.name] = rs
+		s.order = append(s.order, r.name)
+	}
 
 	go func() {
-		url := base + "/" + name
+		url := base + "/" + mc.name
 		defer func() {
 			time.Sleep(20 * time.Second) // delay before retrying
 			close(s.done)
 		}()
 
-		in := open(url)
+		in := openSource(url)
 
 		if in == nil {
 			return
 		}
 
-		index := uint64(time.Now().Unix()) / 10
-		adjust := 3120 * uint64(time.Second)
-		a2m := adtsToMPEGTS(uint64(time.Now().UnixNano())+adjust, 10, true)
-		data := make([]byte, 0, 100000)
+		fanFrames(in, mc.renditions, s.renditions, format)
+	}()
 
-		for c := range in {
-			out, err := a2m(c)
+	return
+}
 
-			if err != nil {
-				s.mutex.Lock()
-				s.list = nil
-				s.mutex.Unlock()
-				return
+// renditionAbort is a rendition's "stop feeding me" signal: closed exactly
+// once, from whichever side of its pipeline gives up first (its packager
+// worker returning early, or, for a transcoded rendition, its transcode
+// backend dying). fanFrames selects on it everywhere it would otherwise
+// send to a rendition that may no longer be reading, so one rendition
+// dying can't wedge the others or fanFrames itself.
+type renditionAbort struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newRenditionAbort() *renditionAbort {
+	return &renditionAbort{ch: make(chan struct{})}
+}
+
+func (a *renditionAbort) fire() { a.once.Do(func() { close(a.ch) }) }
+
+// passthroughWorker is the passthrough "source" rendition's input side.
+type passthroughWorker struct {
+	ch    chan sourceFrame
+	abort *renditionAbort
+}
+
+// transcodeWorker is one transcoded rendition's input side: in feeds frames
+// to transcode.Frames. Because transcoding doesn't preserve a 1:1 mapping
+// between input and output frames, a source discontinuity can't be pinned
+// to one particular output frame; discontinuity instead latches pending
+// until the output wrapper goroutine consumes it, marking the next frame
+// that rendition emits as the discontinuity point.
+type transcodeWorker struct {
+	in            chan adts.Frame
+	abort         *renditionAbort
+	discontinuity atomic.Bool
+}
+
+// fanFrames distributes frames from the mount's single source ingest to one
+// worker per rendition. The passthrough "source" rendition (bitrate 0)
+// receives frames unmodified, StreamTitle metadata included; every other
+// rendition receives audio re-encoded by transcode.Frames at its target
+// bitrate. StreamTitle metadata isn't forwarded to transcoded renditions,
+// since transcoding doesn't preserve a 1:1 mapping between source and
+// output frames. A rendition whose packager returns early, or (for a
+// transcoded rendition) whose backend fails or dies, is dropped from the
+// fan-out rather than blocking it or fanFrames itself - see renditionAbort.
+// Blocks until the source channel closes and every rendition worker has
+// drained.
+func fanFrames(source chan sourceFrame, renditions []rendition, streams map[string]*renditionStream, format segmentFormat) {
+	var wg sync.WaitGroup
+
+	passthrough := map[string]passthroughWorker{}
+	raw := map[string]*transcodeWorker{}
+
+	for _, r := range renditions {
+		rs := streams[r.name]
+		abort := newRenditionAbort()
+
+		if r.bitrate == 0 {
+			ch := make(chan sourceFrame)
+			passthrough[r.name] = passthroughWorker{ch: ch, abort: abort}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer abort.fire()
+				runWorker(rs, ch, format)
+			}()
+			continue
+		}
+
+		w := &transcodeWorker{in: make(chan adts.Frame), abort: abort}
+		raw[r.name] = w
+
+		ch := make(chan sourceFrame)
+		go func() {
+			defer close(ch)
+			defer abort.fire()
+			for frame := range transcode.Frames(w.in, r.bitrate) {
+				sf := sourceFrame{frame: frame, discontinuity: w.discontinuity.Swap(false)}
+				select {
+				case ch <- sf:
+				case <-abort.ch:
+					return
+				}
 			}
+		}()
 
-			for _, o := range out {
-				if ts := mpegts.TS(o); ts.TEI() {
-					//log.Printf("Chunk %d for %s, %d bytes\n", index, name, len(data))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer abort.fire()
+			runWorker(rs, ch, format)
+		}()
+	}
 
-					if len(data) > 0 {
+	for sf := range source {
+		for _, p := range passthrough {
+			select {
+			case p.ch <- sf:
+			case <-p.abort.ch:
+			}
+		}
+		for _, w := range raw {
+			if sf.discontinuity {
+				w.discontinuity.Store(true)
+			}
+			select {
+			case w.in <- sf.frame:
+			case <-w.abort.ch:
+			}
+		}
+	}
 
-						s.mutex.Lock()
-						s.list = append(s.list, chunk{index: index, duration: marker(o).duration(), data: data})
-						for len(s.list) > 10 {
-							s.list = s.list[1:]
-						}
-						s.mutex.Unlock()
-						index++
-					}
+	for _, p := range passthrough {
+		close(p.ch)
+	}
+	for _, w := range raw {
+		close(w.in)
+	}
 
-					data = make([]byte, 0, 100000)
-				} else {
-					data = append(data, o[:]...)
+	wg.Wait()
+}
+
+// runWorker starts the packager appropriate to format and blocks until in closes.
+func runWorker(rs *renditionStream, in chan sourceFrame, format segmentFormat) {
+	if format == formatFMP4 {
+		runFMP4(rs, in)
+	} else {
+		runTS(rs, in)
+	}
+}
+
+// runTS packages the stream as MPEG-TS chunks, with LL-HLS partial segments.
+func runTS(s *renditionStream, in chan sourceFrame) {
+	index := uint64(time.Now().Unix()) / 10
+	adjust := 3120 * uint64(time.Second)
+	a2m := adtsToMPEGTS(uint64(time.Now().UnixNano())+adjust, 10, true, partTarget)
+	data := make([]byte, 0, 100000)
+	partStart := 0         // offset into data where the in-progress part began
+	discontinuity := false // set if any frame packaged into the in-progress segment carried sourceFrame.discontinuity
+
+	s.mutex.Lock()
+	s.current = chunk{index: index, time: time.Now()}
+	s.mutex.Unlock()
+
+	for sf := range in {
+		if sf.discontinuity {
+			discontinuity = true
+		}
+
+		out, err := a2m(sf)
+
+		if err != nil {
+			s.mutex.Lock()
+			s.list = nil
+			s.mutex.Unlock()
+			return
+		}
+
+		for _, o := range out {
+			m := marker(o)
+
+			switch {
+			case mpegts.TS(o).TEI():
+				//log.Printf("Chunk %d for %s, %d bytes\n", index, name, len(data))
+
+				if len(data) > 0 {
+					s.mutex.Lock()
+					s.current.duration = m.duration()
+					s.current.data = data
+					s.current.discontinuity = discontinuity
+					s.list = append(s.list, s.current)
+					s.retainLocked()
+					index++
+					s.current = chunk{index: index, time: time.Now()}
+					s.mutex.Unlock()
+					s.cond.Broadcast()
+				}
+
+				data = make([]byte, 0, 100000)
+				partStart = 0
+				discontinuity = false
+
+			case m.isPart():
+				if len(data) > partStart {
+					s.mutex.Lock()
+					s.current.parts = append(s.current.parts, part{
+						index:    uint64(len(s.current.parts)),
+						duration: m.duration(),
+						offset:   partStart,
+						length:   len(data) - partStart,
+					})
+					s.current.data = data
+					s.mutex.Unlock()
+					s.cond.Broadcast()
 				}
+				partStart = len(data)
+
+			default:
+				data = append(data, o[:]...)
 			}
 		}
-	}()
+	}
+}
 
-	return
+// runFMP4 packages the stream as fMP4/CMAF segments instead of MPEG-TS. The
+// initialization segment is built once, from the first frame's own ADTS
+// header fields, and served separately at init.mp4. LL-HLS partial segments
+// are not produced for this format yet.
+func runFMP4(s *renditionStream, in chan sourceFrame) {
+	const interval = 10 * time.Second
+
+	index := uint64(time.Now().Unix()) / 10
+	var seq uint32
+	var samples [][]byte
+	var durations []uint64
+	var segmentDuration uint64 // ns of audio accumulated in the in-progress segment
+	var baseTime uint64        // ns decode time of the segment's first sample
+	segmentStart := time.Now()
+	discontinuity := false // set if any frame packaged into the in-progress segment carried sourceFrame.discontinuity
+
+	for sf := range in {
+		frame := sf.frame
+
+		if sf.discontinuity {
+			discontinuity = true
+		}
+
+		if frame.NumberAACFramesMinusOne() != 0 {
+			s.mutex.Lock()
+			s.list = nil
+			s.mutex.Unlock()
+			return
+		}
+
+		if s.initSegment() == nil {
+			init := fmp4.InitSegment(frame.Profile(), frame.SamplingFrequencyIndex(), frame.ChannelConfiguration(), uint32(frame.SamplingFrequency()))
+			s.mutex.Lock()
+			s.init = init
+			s.mutex.Unlock()
+		}
+
+		tic := frame.FrameLengthNano()
+		samples = append(samples, frame.AACFrame())
+		durations = append(durations, tic)
+		segmentDuration += tic
+
+		if segmentDuration >= uint64(interval) {
+			data := fmp4.MediaSegment(seq, baseTime, samples, durations)
+
+			s.mutex.Lock()
+			s.list = append(s.list, chunk{index: index, duration: segmentDuration, data: data, time: segmentStart, discontinuity: discontinuity})
+			s.retainLocked()
+			s.mutex.Unlock()
+			s.cond.Broadcast()
+
+			index++
+			seq++
+			segmentStart = time.Now()
+			discontinuity = false
+			baseTime += segmentDuration
+			segmentDuration = 0
+			samples = nil
+			durations = nil
+		}
+	}
 }
 
 type marker [188]byte
@@ -219,6 +791,20 @@ func dummy(timestamp, duration uint64) (dummy marker) {
 	return
 }
 
+// partDummy marks the end of an LL-HLS partial segment. Unlike dummy() it
+// leaves byte 0 as 0x01 rather than the TS sync byte, and byte 1's TEI bit
+// clear, so it can never be confused with a real transport packet or a
+// segment-boundary marker.
+func partDummy(duration uint64) (dummy marker) {
+	dummy[0] = 0x01
+	binary.BigEndian.PutUint64(dummy[2+8:], duration)
+	return
+}
+
+func (m marker) isPart() bool {
+	return m[0] == 0x01
+}
+
 func (m marker) timestamp() uint64 {
 	return binary.BigEndian.Uint64(m[2:])
 }
@@ -247,18 +833,34 @@ func adtsProgramSpecificInformation() func() []packet {
 	return mpegts.ProgramSpecificInformation(program_number, program_map_pid, pid, dsc, esd, esdpid)
 }
 
-func adtsToMPEGTS(start uint64, interval uint, marker bool) func(adts.Frame) ([]packet, error) {
+func adtsToMPEGTS(start uint64, interval uint, marker bool, partInterval time.Duration) func(sourceFrame) ([]packet, error) {
 
 	patpmt := adtsProgramSpecificInformation()
 	pes := packetizedElementaryStream(STREAM_PACKET_IDENTIFIER, STREAM_ID)
+	id3 := packetizedElementaryStream(ESD_PID, ID3_STREAM_ID)
 
 	var totalFramesProcessed uint64
 	var framesSincePAT uint
+	var framesSincePart uint
 	var fps float64
 	var sfq uint
 	var tic uint64
 
-	return func(frame adts.Frame) (out []packet, err error) {
+	return func(sf sourceFrame) (out []packet, err error) {
+
+		frame := sf.frame
+
+		// a signalled discontinuity, or a sampling-frequency change arriving
+		// without one, both mean the timeline restarts here: re-anchor start
+		// on the current PTS and re-derive fps/tic from this frame, rather
+		// than erroring the whole stream out over a source that legitimately
+		// changed encoding parameters mid-stream (eg. after an upstream HLS
+		// discontinuity).
+		if sf.discontinuity || (sfq != 0 && frame.SamplingFrequency() != sfq) {
+			start += tic * totalFramesProcessed
+			totalFramesProcessed = 0
+			sfq = 0
+		}
 
 		if sfq == 0 {
 			sfq = frame.SamplingFrequency()
@@ -270,10 +872,6 @@ func adtsToMPEGTS(start uint64, interval uint, marker bool) func(adts.Frame) ([]
 			tic = frame.FrameLengthNano()
 		}
 
-		if frame.SamplingFrequency() != sfq {
-			return nil, fmt.Errorf("SamplingFrequency changed")
-		}
-
 		if frame.NumberAACFramesMinusOne() != 0 {
 			return nil, fmt.Errorf("NumberAACFrames is greater than one")
 		}
@@ -281,6 +879,13 @@ func adtsToMPEGTS(start uint64, interval uint, marker bool) func(adts.Frame) ([]
 		// if we have more than (approximately) <interval> seconds of audio then reset count to trigger PAT/PMT
 		if framesSincePAT > (uint(fps) * interval) {
 
+			// close out the trailing partial part of the finishing segment first, so that
+			// the sum of its parts' byte ranges covers exactly the finished segment's data
+			if marker && partInterval > 0 && framesSincePart > 0 {
+				out = append(out, partDummy(uint64(framesSincePart)*tic))
+				framesSincePart = 0
+			}
+
 			// and also send a dummy packet (if requested) with some metadata about the chunk which has just finished
 			if marker {
 				out = append(out, dummy(start+tic*totalFramesProcessed, uint64(framesSincePAT)*tic)) // timestamp, duration
@@ -294,11 +899,24 @@ func adtsToMPEGTS(start uint64, interval uint, marker bool) func(adts.Frame) ([]
 			out = append(out, patpmt()...)
 		}
 
+		// independently of PAT/PMT, mark an LL-HLS partial-segment boundary roughly every partInterval
+		if marker && partInterval > 0 && framesSincePart > 0 && uint64(framesSincePart)*tic >= uint64(partInterval) {
+			out = append(out, partDummy(uint64(framesSincePart)*tic))
+			framesSincePart = 0
+		}
+
 		// we kep things simple and send one audio frame per PES packet (which can span multiple 188-byte network packets)
 		out = append(out, pes(frame, start+tic*totalFramesProcessed)...)
 
+		// a changed StreamTitle rides alongside the audio frame it arrived with, as
+		// an ID3v2 TIT2 tag on the ID3 elementary stream declared in the PMT
+		if sf.title != "" {
+			out = append(out, id3(id3StreamTitleTag(sf.title), start+tic*totalFramesProcessed)...)
+		}
+
 		totalFramesProcessed++
 		framesSincePAT++
+		framesSincePart++
 
 		return
 	}
@@ -364,7 +982,38 @@ func packetizedElementaryStream(packetID uint16, streamID uint8) func([]byte, ui
 	}
 }
 
-func open(endpoint string) chan []byte {
+// openSource selects between open and openHLS: an upstream HLS media
+// playlist (recognised by a ".m3u8" suffix, or an HLS playlist Content-Type
+// on a HEAD probe) is pulled and re-packaged by openHLS; anything else is
+// treated as a raw ADTS-over-HTTP source, per open.
+func openSource(endpoint string) chan sourceFrame {
+	if isHLSPlaylist(endpoint) {
+		return openHLS(endpoint)
+	}
+	return open(endpoint)
+}
+
+// isHLSPlaylist reports whether endpoint should be pulled as an HLS media
+// playlist rather than a raw ADTS stream.
+func isHLSPlaylist(endpoint string) bool {
+	if strings.HasSuffix(endpoint, ".m3u8") {
+		return true
+	}
+
+	resp, err := http.Head(endpoint)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	switch resp.Header.Get("Content-Type") {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl":
+		return true
+	}
+	return false
+}
+
+func open(endpoint string) chan sourceFrame {
 
 	headers := map[string]string{}
 
@@ -401,7 +1050,7 @@ func open(endpoint string) chan []byte {
 		}
 	}
 
-	ch := make(chan []byte)
+	ch := make(chan sourceFrame)
 
 	metaint := uint(0)
 
@@ -425,6 +1074,9 @@ func open(endpoint string) chan []byte {
 
 		fn := adts.ADTS()
 
+		title := ""   // last StreamTitle seen
+		pending := "" // StreamTitle to attach to the next completed frame
+
 		for {
 			buff := make([]byte, chunk)
 
@@ -437,11 +1089,19 @@ func open(endpoint string) chan []byte {
 
 			demux(buff, func(b []byte, m bool) {
 				if m {
-					//log.Println(string(b))
+					if t, ok := streamTitle(b); ok && t != title {
+						title = t
+						pending = t
+					}
 				} else {
 					fn(b, func(frame []byte, sync bool) bool {
 						if cromulent && sync {
-							ch <- frame
+							sf := sourceFrame{frame: frame}
+							if pending != "" {
+								sf.title = pending
+								pending = ""
+							}
+							ch <- sf
 							return true
 						}
 						cromulent = false
@@ -509,6 +1169,36 @@ func demuxmeta(mint uint) func([]byte, func([]byte, bool)) {
 	}
 }
 
+// blockingReloadParams extracts the LL-HLS _HLS_msn/_HLS_part query params
+// from a chunklist.m3u8 request, per the CAN-BLOCK-RELOAD contract.
+func blockingReloadParams(r *http.Request) (msn uint64, partIndex uint64, ok bool) {
+	q := r.URL.Query()
+
+	m, err := strconv.ParseUint(q.Get("_HLS_msn"), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	p, _ := strconv.ParseUint(q.Get("_HLS_part"), 10, 64) // defaults to 0 if absent/invalid
+
+	return m, p, true
+}
+
+// rangeSlice applies a single-range "bytes=start-end" Range header to data.
+func rangeSlice(header string, data []byte) ([]byte, bool) {
+	var start, end int
+
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, false
+	}
+
+	if start < 0 || end < start || end >= len(data) {
+		return nil, false
+	}
+
+	return data[start : end+1], true
+}
+
 func server(addr string, directory *directory, redirect string, minimum uint) {
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -533,10 +1223,37 @@ func server(addr string, directory *directory, redirect string, minimum uint) {
 			return
 		}
 
-		re := regexp.MustCompile(`^/([A-Za-z0-9.-_]+)/(|playlist.m3u8|chunklist.m3u8|(\d+).ts)$`)
-		match := re.FindStringSubmatch(r.URL.Path)
+		mountRe := regexp.MustCompile(`^/([A-Za-z0-9.-_]+)/(?:|playlist.m3u8)$`)
+		renditionRe := regexp.MustCompile(`^/([A-Za-z0-9.-_]+)/([A-Za-z0-9.-_]+)/(chunklist.m3u8|init.mp4|(\d+)\.(?:ts|m4s))$`)
+
+		if match := mountRe.FindStringSubmatch(r.URL.Path); match != nil {
+			mountpoint := match[1]
+			mount := directory.find(mountpoint)
+
+			if mount == nil || !mount.ok() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			// eg.: http://hls.example.com/streamname/ or .../streamname/playlist.m3u8
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Header().Set("Connection", "keep-alive")
+
+			fmt.Fprintf(w, "#EXTM3U\n")
+			fmt.Fprintf(w, "#EXT-X-VERSION:3\n")
+			for _, name := range mount.order {
+				rs := mount.renditions[name]
+				fmt.Fprintf(w, "#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n", rs.bandwidth())
+				fmt.Fprintf(w, "%s/chunklist.m3u8\n", name)
+			}
+
+			return
+		}
+
+		match := renditionRe.FindStringSubmatch(r.URL.Path)
 
-		if len(match) != 4 {
+		if match == nil {
 			if redirect != "" {
 				http.Redirect(w, r, redirect, http.StatusSeeOther)
 			} else {
@@ -548,34 +1265,35 @@ func server(addr string, directory *directory, redirect string, minimum uint) {
 		}
 
 		mountpoint := match[1]
-		stream := directory.find(mountpoint)
+		mount := directory.find(mountpoint)
 
-		if stream == nil || stream.index() == nil {
+		if mount == nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		//log.Println(mountpoint, match[3])
-		switch match[2] {
+		stream := mount.renditions[match[2]]
 
-		case "": // eg.: http://hls.example.com/streamname/ - so send the playlist
-			fallthrough
-		case "playlist.m3u8":
-
-			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("Connection", "keep-alive")
+		if stream == nil || stream.index() == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-			fmt.Fprintf(w, "#EXTM3U\n")
-			fmt.Fprintf(w, "#EXT-X-VERSION:3\n")
-			fmt.Fprintf(w, "#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n", stream.bandwidth())
-			fmt.Fprintf(w, "chunklist.m3u8\n")
+		switch match[3] {
 
 		case "chunklist.m3u8":
 
+			llhls := stream.format != formatFMP4
+
+			if llhls {
+				if msn, partIndex, ok := blockingReloadParams(r); ok {
+					stream.awaitPart(msn, partIndex, blockingReloadTimeout)
+				}
+			}
+
 			list := stream.index()
 
-			if len(list) < 3 {
+			if len(list) < minAdvertisedSegments {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
@@ -590,17 +1308,58 @@ func server(addr string, directory *directory, redirect string, minimum uint) {
 			w.WriteHeader(http.StatusOK)
 
 			fmt.Fprintln(w, "#EXTM3U")
-			fmt.Fprintln(w, "#EXT-X-VERSION:3")
+			if llhls {
+				fmt.Fprintln(w, "#EXT-X-VERSION:9")
+			} else {
+				fmt.Fprintln(w, "#EXT-X-VERSION:7")
+				fmt.Fprintln(w, `#EXT-X-MAP:URI="init.mp4"`)
+			}
 			fmt.Fprintln(w, "#EXT-X-TARGETDURATION:12") // >= max segment length
-			fmt.Fprintln(w, "#EXT-X-MEDIA-SEQUENCE: ", list[0][0])
+			if llhls {
+				fmt.Fprintf(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+				fmt.Fprintf(w, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+			}
+			fmt.Fprintln(w, "#EXT-X-MEDIA-SEQUENCE: ", list[0].index)
+
+			for i, v := range list {
+				if i == 0 || v.discontinuity {
+					if i != 0 {
+						fmt.Fprintln(w, "#EXT-X-DISCONTINUITY")
+					}
+					fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", v.time.Format(time.RFC3339Nano))
+				}
+				fmt.Fprintf(w, "#EXTINF:%.2f\n%d.%s\n", float64(v.duration)/1000000000, v.index, stream.extension())
+			}
+
+			if llhls {
+				// parts of the segment still being assembled, plus a hint for the next one to arrive
+				msn, parts := stream.partsOf(list[len(list)-1].index)
+				for _, pt := range parts {
+					fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%d.ts\",BYTERANGE=\"%d@%d\"\n",
+						float64(pt.duration)/1000000000, msn, pt.length, pt.offset)
+				}
+				fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.ts?part=%d\"\n", msn, len(parts))
+			}
+
+		case "init.mp4":
 
-			for _, v := range list {
-				fmt.Fprintf(w, "#EXTINF:%.2f\n%d.ts\n", float64(v[1])/1000000000, v[0])
+			init := stream.initSegment()
+
+			if len(init) < 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
 			}
 
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(init)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(init)
+
 		default:
 
-			index, err := strconv.Atoi(match[3])
+			index, err := strconv.Atoi(match[4])
 
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
@@ -608,6 +1367,22 @@ func server(addr string, directory *directory, redirect string, minimum uint) {
 			}
 
 			chunk := stream.chunk(uint64(index))
+			status := http.StatusOK
+
+			if ps := r.URL.Query().Get("part"); ps != "" {
+				p, err := strconv.ParseUint(ps, 10, 64)
+				if err != nil {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				chunk = stream.part(uint64(index), p)
+				status = http.StatusPartialContent
+			} else if rng := r.Header.Get("Range"); rng != "" {
+				if b, ok := rangeSlice(rng, chunk); ok {
+					chunk = b
+					status = http.StatusPartialContent
+				}
+			}
 
 			if len(chunk) < 1 {
 				w.WriteHeader(http.StatusNotFound)
@@ -621,8 +1396,12 @@ func server(addr string, directory *directory, redirect string, minimum uint) {
 			w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, HEAD")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, User-Agent, If-Modified-Since, Cache-Control, Range")
 			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(chunk)))
-			w.Header().Set("Content-Type", "video/MP2T")
-			w.WriteHeader(http.StatusOK)
+			if stream.format == formatFMP4 {
+				w.Header().Set("Content-Type", "video/mp4")
+			} else {
+				w.Header().Set("Content-Type", "video/MP2T")
+			}
+			w.WriteHeader(status)
 			w.Write(chunk)
 		}
 	})
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"hls/adts"
+	"hls/mpegts"
+)
+
+// playlistSegment is one .ts entry in an HLS media playlist.
+type playlistSegment struct {
+	uri           string
+	discontinuity bool // preceded by #EXT-X-DISCONTINUITY
+}
+
+type mediaPlaylist struct {
+	targetDuration time.Duration
+	mediaSequence  uint64
+	segments       []playlistSegment
+}
+
+// parseMediaPlaylist parses the handful of HLS media playlist tags openHLS
+// needs to follow along an upstream playlist: target duration, media
+// sequence, discontinuities and segment URIs. Unrecognised tags are ignored.
+func parseMediaPlaylist(body []byte) (mediaPlaylist, error) {
+	var pl mediaPlaylist
+	discontinuity := false
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if n, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil {
+				pl.targetDuration = time.Duration(n) * time.Second
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			if n, err := strconv.ParseUint(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64); err == nil {
+				pl.mediaSequence = n
+			}
+
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+
+		case line == "" || strings.HasPrefix(line, "#"):
+			// other tags/comments, not needed here
+
+		default:
+			pl.segments = append(pl.segments, playlistSegment{uri: line, discontinuity: discontinuity})
+			discontinuity = false
+		}
+	}
+
+	if pl.targetDuration == 0 {
+		return pl, fmt.Errorf("missing EXT-X-TARGETDURATION")
+	}
+
+	return pl, nil
+}
+
+// resolveURL resolves a playlist-relative URI (segment or child playlist)
+// against the URL it was fetched from.
+func resolveURL(endpoint, ref string) string {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return ref
+	}
+	rel, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(rel).String()
+}
+
+// openHLS pulls audio from an upstream HLS media playlist instead of a raw
+// ADTS stream: it polls the playlist at half its target duration, fetches
+// new .ts segments in the order the playlist lists them, demuxes each into
+// ADTS frames with demuxTSFrames, and pushes them down the returned channel
+// exactly as open does for a raw ADTS-over-HTTP source. A segment preceded
+// by #EXT-X-DISCONTINUITY marks its first frame as a soft-restart point, so
+// a sampling-frequency change across it doesn't kill the whole stream (see
+// adtsToMPEGTS).
+func openHLS(endpoint string) chan sourceFrame {
+	ch := make(chan sourceFrame)
+
+	go func() {
+		defer close(ch)
+
+		var mediaSequence uint64
+		first := true
+
+		for {
+			resp, err := http.Get(endpoint)
+			if err != nil {
+				return
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return
+			}
+
+			pl, err := parseMediaPlaylist(body)
+			if err != nil {
+				return
+			}
+
+			if first {
+				mediaSequence = pl.mediaSequence
+				first = false
+			}
+
+			skip := int(int64(mediaSequence) - int64(pl.mediaSequence))
+			if skip < 0 {
+				// playlist has moved past segments we never read - resync to its first segment
+				mediaSequence = pl.mediaSequence
+				skip = 0
+			}
+			if skip > len(pl.segments) {
+				skip = len(pl.segments)
+			}
+
+			for _, seg := range pl.segments[skip:] {
+				frames, err := fetchHLSSegment(resolveURL(endpoint, seg.uri))
+				if err != nil {
+					return
+				}
+
+				for i, frame := range frames {
+					ch <- sourceFrame{frame: frame, discontinuity: seg.discontinuity && i == 0}
+				}
+
+				mediaSequence++
+			}
+
+			time.Sleep(pl.targetDuration / 2)
+		}
+	}()
+
+	return ch
+}
+
+// fetchHLSSegment fetches a single .ts segment and demuxes its AAC
+// elementary stream into ADTS frames.
+func fetchHLSSegment(url string) ([]adts.Frame, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return demuxTSFrames(body)
+}
+
+// patPID is the reserved MPEG-TS PID that always carries the Program
+// Association Table, regardless of who muxed the stream - unlike
+// PROGRAM_MAP_PID in hls.go, which is just where this repo's own muxer
+// happens to put its PMT.
+const patPID = 0x0000
+
+// demuxTSFrames recovers ADTS AAC frames from a raw MPEG-TS buffer produced
+// by an arbitrary upstream HLS source: it resolves the PMT's PID from the
+// PAT, finds the audio elementary stream's PID from that PMT, reassembles
+// that PID's PES packets, and strips the PES headers off each to recover
+// the ADTS frame data.
+func demuxTSFrames(data []byte) (frames []adts.Frame, err error) {
+	var pmtPID uint16
+	havePMTPID := false
+
+	var audioPID uint16
+	havePID := false
+
+	var pes []byte
+	inPES := false
+
+	flush := func() {
+		if !inPES || len(pes) == 0 {
+			return
+		}
+		if fs, ok := extractADTSFrames(pes); ok {
+			frames = append(frames, fs...)
+		}
+	}
+
+	for len(data) >= 188 {
+		var pkt packet
+		copy(pkt[:], data[:188])
+		data = data[188:]
+
+		ts := mpegts.TS(pkt)
+
+		if ts.TEI() {
+			continue
+		}
+
+		pid := ts.PID()
+
+		if pid == patPID {
+			if p, ok := mpegts.ParseProgramAssociation(ts.Payload()); ok {
+				pmtPID, havePMTPID = p, true
+			}
+			continue
+		}
+
+		if havePMTPID && pid == pmtPID {
+			if p, ok := mpegts.ParseProgramMap(ts.Payload()); ok {
+				audioPID, havePID = p, true
+			}
+			continue
+		}
+
+		if !havePID || pid != audioPID {
+			continue
+		}
+
+		if ts.PUSI() {
+			flush()
+			pes = append([]byte{}, ts.Payload()...)
+			inPES = true
+			continue
+		}
+
+		if inPES {
+			pes = append(pes, ts.Payload()...)
+		}
+	}
+
+	flush()
+
+	if !havePID {
+		return nil, fmt.Errorf("no audio PID found in PMT")
+	}
+
+	return frames, nil
+}
+
+// extractADTSFrames strips a PES header off pes and re-syncs the remaining
+// bytes as ADTS frames.
+func extractADTSFrames(pes []byte) (frames []adts.Frame, ok bool) {
+	_, _, data, ok := mpegts.ParsePES(pes)
+	if !ok {
+		return nil, false
+	}
+
+	fn := adts.ADTS()
+	fn(data, func(frame []byte, sync bool) bool {
+		if sync {
+			frames = append(frames, adts.Frame(frame))
+		}
+		return true
+	})
+
+	return frames, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+	"regexp"
+)
+
+var streamTitleRegexp = regexp.MustCompile(`StreamTitle='([^']*)';`)
+
+// streamTitle extracts the StreamTitle value from a raw Icecast/Shoutcast
+// metadata block, as demuxed by demuxmeta.
+func streamTitle(meta []byte) (title string, ok bool) {
+	m := streamTitleRegexp.FindSubmatch(meta)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+// id3StreamTitleTag builds a minimal ID3v2.4 tag containing a single TIT2
+// (title) frame, for carrying an Icecast StreamTitle as in-band timed
+// metadata alongside the audio PES.
+func id3StreamTitleTag(title string) []byte {
+	content := append([]byte{3}, []byte(title)...) // text encoding 3 = UTF-8
+
+	frame := make([]byte, 10+len(content))
+	copy(frame[0:4], "TIT2")
+	binary.BigEndian.PutUint32(frame[4:8], syncsafe(uint32(len(content))))
+	copy(frame[10:], content)
+
+	tag := make([]byte, 10+len(frame))
+	copy(tag[0:3], "ID3")
+	tag[3] = 4 // version 2.4.0
+	binary.BigEndian.PutUint32(tag[6:10], syncsafe(uint32(len(frame))))
+	copy(tag[10:], frame)
+
+	return tag
+}
+
+// syncsafe encodes the low 28 bits of n as an ID3v2 syncsafe integer: four
+// bytes with the top bit of each byte cleared.
+func syncsafe(n uint32) uint32 {
+	return (n & 0x7f) | (n&0x3f80)<<1 | (n&0x1fc000)<<2 | (n&0xfe00000)<<3
+}
@@ -0,0 +1,33 @@
+//go:build fdkaac
+
+package transcode
+
+/*
+#cgo LDFLAGS: -lfdk-aac
+#include <fdk-aac/aacenc_lib.h>
+#include <fdk-aac/aacdecoder_lib.h>
+*/
+import "C"
+
+import "hls/adts"
+
+// Frames, in a build with the fdkaac tag, does not transcode: no libfdk-aac
+// decoder or encoder is called, although the headers above are included
+// and the library is linked. It discards every frame read from in, and the
+// returned channel receives no frames; it is closed once in has been
+// closed and drained. bitrate is not used. Builds without the fdkaac tag
+// use the ffmpeg backend instead (see ffmpeg.go).
+//
+// in is drained to completion so that a caller feeding frames into it
+// doesn't block forever on a channel nobody reads.
+func Frames(in <-chan adts.Frame, bitrate uint) <-chan adts.Frame {
+	out := make(chan adts.Frame)
+
+	go func() {
+		defer close(out)
+		for range in {
+		}
+	}()
+
+	return out
+}
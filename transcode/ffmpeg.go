@@ -0,0 +1,76 @@
+//go:build !fdkaac
+
+package transcode
+
+import (
+	"fmt"
+	"os/exec"
+
+	"hls/adts"
+)
+
+// Frames re-encodes ADTS AAC frames to the given target bitrate by piping
+// them through an external ffmpeg process, ADTS in and ADTS out over
+// stdio. This is the default backend, requiring only an ffmpeg binary on
+// PATH rather than a libfdk-aac build (see fdkaac.go).
+func Frames(in <-chan adts.Frame, bitrate uint) <-chan adts.Frame {
+	out := make(chan adts.Frame)
+
+	cmd := exec.Command("ffmpeg",
+		"-loglevel", "error",
+		"-f", "aac", "-i", "pipe:0",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", bitrate/1000),
+		"-f", "adts", "pipe:1",
+	)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		close(out)
+		return out
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		close(out)
+		return out
+	}
+
+	if err := cmd.Start(); err != nil {
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer stdin.Close()
+		for frame := range in {
+			if _, err := stdin.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		defer cmd.Wait()
+
+		fn := adts.ADTS()
+		buff := make([]byte, 8192)
+
+		for {
+			n, err := stdout.Read(buff)
+			if n > 0 {
+				fn(buff[:n], func(frame []byte, sync bool) bool {
+					if sync {
+						out <- frame
+					}
+					return true
+				})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,8 @@
+// Package transcode re-encodes a stream of ADTS AAC frames to a different
+// target bitrate, for serving multiple renditions of the same source at
+// different qualities.
+//
+// Frames is implemented in ffmpeg.go (the default build) and fdkaac.go
+// (build tag "fdkaac"); exactly one is compiled in, chosen by build tag.
+// Only the ffmpeg.go backend re-encodes; the fdkaac.go one emits no frames.
+package transcode